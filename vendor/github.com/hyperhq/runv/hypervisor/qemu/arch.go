@@ -0,0 +1,194 @@
+// +build linux
+
+package qemu
+
+import "strconv"
+
+// Bridge describes a bus bridge that devices of a given class attach to,
+// e.g. a PCIe root port on arm64 or a virtual css bus on s390x.
+type Bridge struct {
+	Id     string
+	Driver string
+	Bus    string
+}
+
+// Device is a device launchQemu should add regardless of guest config, e.g.
+// a platform's base console or RTC device.
+type Device struct {
+	Driver    string
+	Arguments map[string]interface{}
+}
+
+// QemuArch hides the per-architecture device-model differences (q35/pc vs
+// virt vs pseries vs ccw) behind one interface, so SetCpus, AddMem, AddDisk,
+// AddNic and launchQemu no longer need to fork their whole codepath per
+// runtime.GOARCH the way the qmp_wrapper_<arch>.go shims used to.
+type QemuArch interface {
+	// Machine is the "-machine" type string, e.g. "q35", "virt", "pseries".
+	Machine() string
+	// CPUModel is the "-cpu" model string launchQemu should pass.
+	CPUModel() string
+	// HotplugCPU returns the QMP commands needed to bring vCPU id online.
+	HotplugCPU(id int) []*QmpCommand
+	// HotplugMemory returns the QMP commands needed to plug sizeMB of RAM
+	// into slot.
+	HotplugMemory(slot, sizeMB int) []*QmpCommand
+	// DiskDriver is the device_add "driver" value for a disk attached at id.
+	DiskDriver(id string) string
+	// NicDriver is the device_add "driver" value for a guest nic.
+	NicDriver() string
+	// Bridges lists the bridges launchQemu should create disks/nics on.
+	Bridges() []Bridge
+	// DefaultDevices are devices launchQemu should always add, regardless
+	// of guest config.
+	DefaultDevices() []Device
+	// SupportsNvdimm reports whether this arch/machine can back DAX volumes
+	// with nvdimm devices; see nvdimm.go.
+	SupportsNvdimm() bool
+}
+
+// archFor selects the QemuArch backend for a runtime.GOARCH-style name,
+// falling back to the amd64 backend for anything unrecognized.
+func archFor(goarch string) QemuArch {
+	switch goarch {
+	case "arm64":
+		return &arm64Arch{}
+	case "ppc64le":
+		return &ppc64leArch{}
+	case "s390x":
+		return &s390xArch{}
+	default:
+		return &amd64Arch{}
+	}
+}
+
+// amd64Arch targets q35 with the device model hyperd has always used.
+type amd64Arch struct{}
+
+func (amd64Arch) Machine() string  { return "q35" }
+func (amd64Arch) CPUModel() string { return "host" }
+
+func (amd64Arch) HotplugCPU(id int) []*QmpCommand {
+	return []*QmpCommand{{
+		Execute:   "cpu-add",
+		Arguments: map[string]interface{}{"id": id},
+	}}
+}
+
+func (amd64Arch) HotplugMemory(slot, sizeMB int) []*QmpCommand {
+	return pcDimmHotplug(slot, sizeMB)
+}
+
+func (amd64Arch) DiskDriver(id string) string { return "scsi-hd" }
+func (amd64Arch) NicDriver() string           { return "virtio-net-pci" }
+func (amd64Arch) Bridges() []Bridge           { return nil }
+func (amd64Arch) DefaultDevices() []Device    { return nil }
+func (amd64Arch) SupportsNvdimm() bool        { return true }
+
+// arm64Arch targets the "virt" board, which needs an explicit gic and PCIe
+// root complex that amd64's q35 gets for free.
+type arm64Arch struct{}
+
+func (arm64Arch) Machine() string  { return "virt" }
+func (arm64Arch) CPUModel() string { return "host" }
+
+func (arm64Arch) HotplugCPU(id int) []*QmpCommand {
+	return []*QmpCommand{{
+		Execute:   "cpu-add",
+		Arguments: map[string]interface{}{"id": id},
+	}}
+}
+
+func (arm64Arch) HotplugMemory(slot, sizeMB int) []*QmpCommand {
+	return pcDimmHotplug(slot, sizeMB)
+}
+
+func (arm64Arch) DiskDriver(id string) string { return "virtio-blk-pci" }
+func (arm64Arch) NicDriver() string           { return "virtio-net-pci" }
+
+func (arm64Arch) Bridges() []Bridge {
+	return []Bridge{{Id: "pcie.0", Driver: "gpex-pcihost", Bus: "pcie.0"}}
+}
+
+func (arm64Arch) DefaultDevices() []Device {
+	return []Device{{Driver: "virtio-gpu-pci"}}
+}
+
+func (arm64Arch) SupportsNvdimm() bool { return true }
+
+// ppc64leArch targets pseries, which hotplugs vCPUs as sPAPR CPU cores
+// instead of qemu's generic cpu-add and has no nvdimm support.
+type ppc64leArch struct{}
+
+func (ppc64leArch) Machine() string  { return "pseries" }
+func (ppc64leArch) CPUModel() string { return "POWER9" }
+
+func (ppc64leArch) HotplugCPU(id int) []*QmpCommand {
+	core := "core" + strconv.Itoa(id)
+	return []*QmpCommand{{
+		Execute: "device_add",
+		Arguments: map[string]interface{}{
+			"driver":  "POWER9-spapr-cpu-core",
+			"id":      core,
+			"core-id": id,
+		},
+	}}
+}
+
+func (ppc64leArch) HotplugMemory(slot, sizeMB int) []*QmpCommand {
+	return pcDimmHotplug(slot, sizeMB)
+}
+
+func (ppc64leArch) DiskDriver(id string) string { return "scsi-hd" }
+func (ppc64leArch) NicDriver() string           { return "virtio-net-pci" }
+func (ppc64leArch) Bridges() []Bridge           { return nil }
+func (ppc64leArch) DefaultDevices() []Device    { return nil }
+func (ppc64leArch) SupportsNvdimm() bool        { return false }
+
+// s390xArch targets s390-ccw-virtio, whose devices attach to the virtual
+// channel subsystem bus (ccw) rather than PCI.
+type s390xArch struct{}
+
+func (s390xArch) Machine() string  { return "s390-ccw-virtio" }
+func (s390xArch) CPUModel() string { return "host" }
+
+func (s390xArch) HotplugCPU(id int) []*QmpCommand {
+	return []*QmpCommand{{
+		Execute:   "cpu-add",
+		Arguments: map[string]interface{}{"id": id},
+	}}
+}
+
+func (s390xArch) HotplugMemory(slot, sizeMB int) []*QmpCommand {
+	return pcDimmHotplug(slot, sizeMB)
+}
+
+func (s390xArch) DiskDriver(id string) string { return "virtio-blk-ccw" }
+func (s390xArch) NicDriver() string           { return "virtio-net-ccw" }
+func (s390xArch) Bridges() []Bridge           { return nil }
+func (s390xArch) DefaultDevices() []Device    { return nil }
+func (s390xArch) SupportsNvdimm() bool        { return false }
+
+// pcDimmHotplug is the object-add + device_add pair shared by every arch
+// that still hotplugs memory as a pc-dimm (amd64, arm64, ppc64le, s390x all
+// do; only the machine type and bus differ for disks/nics).
+func pcDimmHotplug(slot, sizeMB int) []*QmpCommand {
+	return []*QmpCommand{
+		{
+			Execute: "object-add",
+			Arguments: map[string]interface{}{
+				"qom-type": "memory-backend-ram",
+				"id":       "mem" + strconv.Itoa(slot),
+				"props":    map[string]interface{}{"size": int64(sizeMB) << 20},
+			},
+		},
+		{
+			Execute: "device_add",
+			Arguments: map[string]interface{}{
+				"driver": "pc-dimm",
+				"id":     "dimm" + strconv.Itoa(slot),
+				"memdev": "mem" + strconv.Itoa(slot),
+			},
+		},
+	}
+}
@@ -0,0 +1,65 @@
+// +build linux
+
+package qemu
+
+import "testing"
+
+func TestArchForSelectsKnownBackends(t *testing.T) {
+	cases := []struct {
+		goarch  string
+		machine string
+	}{
+		{"amd64", "q35"},
+		{"arm64", "virt"},
+		{"ppc64le", "pseries"},
+		{"s390x", "s390-ccw-virtio"},
+		{"some-unknown-arch", "q35"}, // falls back to amd64
+	}
+
+	for _, c := range cases {
+		arch := archFor(c.goarch)
+		if got := arch.Machine(); got != c.machine {
+			t.Errorf("archFor(%q).Machine() = %q, want %q", c.goarch, got, c.machine)
+		}
+		if arch.CPUModel() == "" {
+			t.Errorf("archFor(%q).CPUModel() must not be empty", c.goarch)
+		}
+		if len(arch.HotplugCPU(0)) == 0 {
+			t.Errorf("archFor(%q).HotplugCPU(0) must return at least one command", c.goarch)
+		}
+		if len(arch.HotplugMemory(0, 128)) == 0 {
+			t.Errorf("archFor(%q).HotplugMemory(0, 128) must return at least one command", c.goarch)
+		}
+		if arch.DiskDriver("disk0") == "" {
+			t.Errorf("archFor(%q).DiskDriver(...) must not be empty", c.goarch)
+		}
+		if arch.NicDriver() == "" {
+			t.Errorf("archFor(%q).NicDriver() must not be empty", c.goarch)
+		}
+	}
+}
+
+func TestPpc64leHotplugsCpuAsSpaprCore(t *testing.T) {
+	commands := (&ppc64leArch{}).HotplugCPU(3)
+	if len(commands) != 1 {
+		t.Fatalf("ppc64leArch.HotplugCPU(3) returned %d commands, want 1", len(commands))
+	}
+	if got := commands[0].Execute; got != "device_add" {
+		t.Fatalf("ppc64leArch.HotplugCPU(3) executes %q, want device_add", got)
+	}
+	if got := commands[0].Arguments["driver"]; got != "POWER9-spapr-cpu-core" {
+		t.Fatalf("ppc64leArch.HotplugCPU(3) driver = %v, want POWER9-spapr-cpu-core", got)
+	}
+}
+
+func TestNvdimmSupportMatchesMachineCapability(t *testing.T) {
+	if !(amd64Arch{}).SupportsNvdimm() {
+		t.Error("amd64Arch should support nvdimm")
+	}
+	if (ppc64leArch{}).SupportsNvdimm() {
+		t.Error("ppc64leArch should not support nvdimm")
+	}
+	if (s390xArch{}).SupportsNvdimm() {
+		t.Error("s390xArch should not support nvdimm")
+	}
+}
@@ -0,0 +1,276 @@
+// +build linux
+
+package qemu
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/hyperhq/runv/hypervisor"
+)
+
+// QmpEventType enumerates the asynchronous QMP events QemuContext surfaces
+// on its Events() channel.
+type QmpEventType string
+
+const (
+	EventShutdown           QmpEventType = "SHUTDOWN"
+	EventReset              QmpEventType = "RESET"
+	EventStop               QmpEventType = "STOP"
+	EventResume             QmpEventType = "RESUME"
+	EventGuestPanicked      QmpEventType = "GUEST_PANICKED"
+	EventNicRxFilterChanged QmpEventType = "NIC_RX_FILTER_CHANGED"
+	EventBlockIoError       QmpEventType = "BLOCK_IO_ERROR"
+	EventMemUnplugError     QmpEventType = "MEM_UNPLUG_ERROR"
+	EventMigration          QmpEventType = "MIGRATION"
+	EventPowerdown          QmpEventType = "POWERDOWN"
+)
+
+// QmpEvent is a typed, decoded asynchronous QMP event.
+type QmpEvent struct {
+	Type      QmpEventType
+	Timestamp time.Time
+	Data      map[string]interface{}
+}
+
+// Events returns a channel of asynchronous QMP events (guest panics, IO
+// errors, migration status changes, power state changes, ...) so higher
+// layers can react to them directly instead of polling qc.Stats()/qc.Pause().
+// The channel is closed when the sandbox's event listener exits.
+func (qc *QemuContext) Events() <-chan QmpEvent {
+	return qc.events
+}
+
+// dispatchEvent publishes a decoded QMP event on qc.events. It never
+// blocks: a slow or absent subscriber drops events rather than stalling
+// the event listener.
+func (qc *QemuContext) dispatchEvent(ev QmpEvent) {
+	select {
+	case qc.events <- ev:
+	default:
+		glog.Warningf("dropped QMP event %s: no room on events channel", ev.Type)
+	}
+}
+
+const eventListenerRetryInterval = 1 * time.Second
+
+// runEventListener opens its own monitor connection to the sandbox's QMP
+// socket, separate from the qmp/qmpHandler command channel, and decodes
+// every event message qemu sends on it into qc.events. It reconnects on
+// error until qc.eventsStop is closed by Close().
+func (qc *QemuContext) runEventListener(ctx *hypervisor.VmContext) {
+	defer close(qc.events)
+
+	for {
+		conn, err := net.Dial("unix", qc.qmpSockName)
+		if err != nil {
+			glog.V(1).Infof("event listener for sandbox %s: dial failed, retrying: %v", ctx.Id, err)
+			if !qc.sleepOrStop(eventListenerRetryInterval) {
+				return
+			}
+			continue
+		}
+
+		qc.readEvents(ctx, conn)
+		conn.Close()
+
+		if !qc.sleepOrStop(eventListenerRetryInterval) {
+			return
+		}
+	}
+}
+
+// sleepOrStop waits for d, returning false early (without having slept the
+// full duration) if qc.eventsStop is closed in the meantime.
+func (qc *QemuContext) sleepOrStop(d time.Duration) bool {
+	select {
+	case <-qc.eventsStop:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// readEvents completes the QMP handshake on conn and decodes events off it
+// until the connection errors out. It does not watch qc.eventsStop itself;
+// runEventListener checks that between connections.
+func (qc *QemuContext) readEvents(ctx *hypervisor.VmContext, conn net.Conn) {
+	reader := bufio.NewReader(conn)
+
+	// the first message on a fresh connection is qemu's capabilities
+	// greeting; ack it so qemu starts treating this connection as a live
+	// monitor and delivers events on it.
+	if _, err := reader.ReadBytes('\n'); err != nil {
+		return
+	}
+	if err := json.NewEncoder(conn).Encode(map[string]interface{}{"execute": "qmp_capabilities"}); err != nil {
+		return
+	}
+	if _, err := reader.ReadBytes('\n'); err != nil {
+		return
+	}
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			glog.V(1).Infof("event listener for sandbox %s: connection closed: %v", ctx.Id, err)
+			return
+		}
+
+		var msg map[string]interface{}
+		if err := json.Unmarshal(line, &msg); err != nil {
+			continue
+		}
+
+		ev, ok := parseQmpEvent(msg)
+		if !ok {
+			continue
+		}
+		qc.dispatchEvent(ev)
+	}
+}
+
+// parseQmpEvent decodes a raw QMP monitor message into a QmpEvent, and
+// reports false for messages that aren't events (command replies, etc).
+func parseQmpEvent(msg map[string]interface{}) (QmpEvent, bool) {
+	name, ok := msg["event"].(string)
+	if !ok {
+		return QmpEvent{}, false
+	}
+
+	ev := QmpEvent{Type: QmpEventType(name)}
+	if ts, ok := msg["timestamp"].(map[string]interface{}); ok {
+		seconds := int64(asUint64(ts["seconds"]))
+		micros := int64(asUint64(ts["microseconds"]))
+		ev.Timestamp = time.Unix(seconds, micros*1000)
+	}
+	if data, ok := msg["data"].(map[string]interface{}); ok {
+		ev.Data = data
+	}
+	return ev, true
+}
+
+// WatchdogPolicy decides how the watchdog goroutine reacts once it decides
+// the guest is unresponsive.
+type WatchdogPolicy string
+
+const (
+	WatchdogReset     WatchdogPolicy = "reset"
+	WatchdogPowerdown WatchdogPolicy = "powerdown"
+	WatchdogNmi       WatchdogPolicy = "nmi"
+	WatchdogKill      WatchdogPolicy = "kill"
+	WatchdogQuit      WatchdogPolicy = "quit"
+)
+
+const (
+	watchdogPollInterval = 5 * time.Second
+	watchdogQueryTimeout = 2 * time.Second
+	watchdogMaxMisses    = 3
+)
+
+// watchdog polls query-status on an interval and, once watchdogMaxMisses
+// consecutive polls fail or time out (indicating the qemu process is wedged
+// or the QMP socket is gone), applies qc.policy. Reset/powerdown/nmi are
+// non-terminal: the guest is expected to recover, so watchdog keeps polling
+// for it afterward. kill/quit are terminal -- those are pushed onto qc.wdt
+// for the process-level consumer to act on, and watchdog stops monitoring a
+// sandbox it expects to be torn down. Each poll is bounded by
+// watchdogQueryTimeout, so a wedged QMP connection can't stall the polling
+// itself; the reset/powerdown/nmi commands applyWatchdogPolicy sends, however,
+// wait for qemu's reply with no deadline.
+func (qc *QemuContext) watchdog(ctx *hypervisor.VmContext) {
+	ticker := time.NewTicker(watchdogPollInterval)
+	defer ticker.Stop()
+
+	misses := 0
+	for range ticker.C {
+		if _, err := qc.qmpQueryTimeout(ctx, "query-status", nil, watchdogQueryTimeout); err != nil {
+			misses++
+			if misses < watchdogMaxMisses {
+				continue
+			}
+			glog.Errorf("watchdog: sandbox %s unresponsive after %d polls, applying policy %s", ctx.Id, misses, qc.policy)
+			if qc.applyWatchdogPolicy(ctx) {
+				return
+			}
+			misses = 0
+			continue
+		}
+		misses = 0
+	}
+}
+
+// applyWatchdogPolicy acts on qc.policy (defaulting to WatchdogKill) and
+// reports whether the policy is terminal for this sandbox, i.e. whether
+// watchdog should stop monitoring it afterward.
+func (qc *QemuContext) applyWatchdogPolicy(ctx *hypervisor.VmContext) bool {
+	policy := qc.policy
+	if policy == "" {
+		policy = WatchdogKill
+	}
+
+	switch policy {
+	case WatchdogReset:
+		if err := qc.Reset(ctx); err != nil {
+			glog.Errorf("watchdog: sandbox %s system_reset failed: %v", ctx.Id, err)
+		}
+		return false
+	case WatchdogPowerdown:
+		if err := qc.PowerDown(ctx); err != nil {
+			glog.Errorf("watchdog: sandbox %s system_powerdown failed: %v", ctx.Id, err)
+		}
+		return false
+	case WatchdogNmi:
+		if err := qc.Nmi(ctx); err != nil {
+			glog.Errorf("watchdog: sandbox %s inject-nmi failed: %v", ctx.Id, err)
+		}
+		return false
+	}
+
+	func() {
+		defer func() {
+			// the wdt channel may already be closed if Close() raced us
+			recover()
+		}()
+		qc.wdt <- string(policy)
+	}()
+	return true
+}
+
+// Reset issues a QMP system_reset to the guest.
+func (qc *QemuContext) Reset(ctx *hypervisor.VmContext) error {
+	result := make(chan error, 1)
+	qc.qmpSend(ctx, &QmpSession{
+		commands: []*QmpCommand{{Execute: "system_reset"}},
+		respond:  func(err error) { result <- err },
+	})
+	return <-result
+}
+
+// PowerDown issues a QMP system_powerdown, asking the guest to shut itself
+// down gracefully (ACPI power button equivalent).
+func (qc *QemuContext) PowerDown(ctx *hypervisor.VmContext) error {
+	result := make(chan error, 1)
+	qc.qmpSend(ctx, &QmpSession{
+		commands: []*QmpCommand{{Execute: "system_powerdown"}},
+		respond:  func(err error) { result <- err },
+	})
+	return <-result
+}
+
+// Nmi injects a non-maskable interrupt into every vCPU, which most guest
+// kernels are configured to treat as a fatal, dump-and-halt signal.
+func (qc *QemuContext) Nmi(ctx *hypervisor.VmContext) error {
+	result := make(chan error, 1)
+	qc.qmpSend(ctx, &QmpSession{
+		commands: []*QmpCommand{{
+			Execute:   "inject-nmi",
+			Arguments: map[string]interface{}{},
+		}},
+		respond: func(err error) { result <- err },
+	})
+	return <-result
+}
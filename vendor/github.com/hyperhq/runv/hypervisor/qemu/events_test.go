@@ -0,0 +1,58 @@
+// +build linux
+
+package qemu
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseQmpEventDecodesEventMessages(t *testing.T) {
+	msg := map[string]interface{}{
+		"event": "GUEST_PANICKED",
+		"timestamp": map[string]interface{}{
+			"seconds":      float64(1000),
+			"microseconds": float64(500),
+		},
+		"data": map[string]interface{}{"action": "pause"},
+	}
+
+	ev, ok := parseQmpEvent(msg)
+	if !ok {
+		t.Fatal("parseQmpEvent should accept a message with an \"event\" field")
+	}
+	if ev.Type != EventGuestPanicked {
+		t.Fatalf("ev.Type = %q, want %q", ev.Type, EventGuestPanicked)
+	}
+	if ev.Data["action"] != "pause" {
+		t.Fatalf("ev.Data[\"action\"] = %v, want %q", ev.Data["action"], "pause")
+	}
+	want := time.Unix(1000, 500*1000)
+	if !ev.Timestamp.Equal(want) {
+		t.Fatalf("ev.Timestamp = %v, want %v", ev.Timestamp, want)
+	}
+}
+
+func TestParseQmpEventRejectsNonEventMessages(t *testing.T) {
+	msg := map[string]interface{}{"return": map[string]interface{}{}}
+
+	if _, ok := parseQmpEvent(msg); ok {
+		t.Fatal("parseQmpEvent should reject a command-reply message with no \"event\" field")
+	}
+}
+
+func TestDispatchEventDropsRatherThanBlocks(t *testing.T) {
+	qc := &QemuContext{events: make(chan QmpEvent)} // unbuffered: no reader ready
+
+	done := make(chan struct{})
+	go func() {
+		qc.dispatchEvent(QmpEvent{Type: EventStop})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("dispatchEvent blocked instead of dropping the event")
+	}
+}
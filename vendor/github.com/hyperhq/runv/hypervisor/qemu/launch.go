@@ -0,0 +1,97 @@
+// +build linux
+
+package qemu
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+
+	"github.com/golang/glog"
+	"github.com/hyperhq/runv/hypervisor"
+)
+
+// launchQemu assembles qemu's argv from the QemuContext fields Launch()
+// fills in and starts the process, recording it in qc.process so
+// Dump()/Stats()/Kill() can find it again. Launch() calls this in its own
+// goroutine, so failures here are only reported via glog; the watchdog will
+// notice the sandbox never comes up and apply qc.policy.
+func launchQemu(qc *QemuContext, ctx *hypervisor.VmContext) {
+	args := qemuArgs(qc, ctx)
+
+	cmd := exec.Command(qc.driver.executable, args...)
+	if err := cmd.Start(); err != nil {
+		glog.Errorf("failed to launch qemu for sandbox %s: %v", ctx.Id, err)
+		return
+	}
+	qc.process = cmd.Process
+}
+
+// qemuArgs builds qemu's command line for ctx/qc. Launch() is responsible
+// for filling in the qc fields this reads (machine, cpuModel, bridges,
+// defaultDevices from qc.driver.arch; incomingURI from
+// InitIncomingContext/InitRestoreContext) before calling launchQemu.
+func qemuArgs(qc *QemuContext, ctx *hypervisor.VmContext) []string {
+	args := []string{
+		"-name", ctx.Id,
+		"-pidfile", qc.qemuPidFile,
+		"-D", qc.qemuLogFile.Name,
+		"-qmp", fmt.Sprintf("unix:%s,server,nowait", qc.qmpSockName),
+		"-machine", machineArg(qc.machine, qc.nvdimmMachineArgs),
+		"-cpu", qc.cpuModel,
+	}
+	args = append(args, deviceArgs(qc.bridges, qc.defaultDevices)...)
+
+	// incomingURI is set by InitIncomingContext (live migration hand-off) or
+	// InitRestoreContext (external snapshot restore); either way, qemu needs
+	// to come up waiting to receive guest RAM/device state on it instead of
+	// booting a fresh guest.
+	if qc.incomingURI != "" {
+		args = append(args, "-incoming", qc.incomingURI)
+	}
+
+	return args
+}
+
+// machineArg appends nvdimmArgs (qc.nvdimmMachineArgs, set by Launch() only
+// when qc.driver.arch.SupportsNvdimm()) onto base (qc.machine) to form the
+// final "-machine" value, so qemu reserves maxmem room for DAX-backed disks
+// added later via AddDisk whenever the arch supports it.
+func machineArg(base, nvdimmArgs string) string {
+	if nvdimmArgs == "" {
+		return base
+	}
+	return base + "," + nvdimmArgs
+}
+
+// deviceArgs turns bridges and defaultDevices -- populated from
+// qc.driver.arch by Launch() -- into "-device" argv pairs: one bridge device
+// per entry in bridges, then one per entry in defaultDevices.
+func deviceArgs(bridges []Bridge, defaultDevices []Device) []string {
+	var args []string
+	for _, b := range bridges {
+		args = append(args, "-device", bridgeDeviceArg(b))
+	}
+	for _, d := range defaultDevices {
+		args = append(args, "-device", defaultDeviceArg(d))
+	}
+	return args
+}
+
+func bridgeDeviceArg(b Bridge) string {
+	return fmt.Sprintf("%s,id=%s,bus=%s", b.Driver, b.Id, b.Bus)
+}
+
+func defaultDeviceArg(d Device) string {
+	keys := make([]string, 0, len(d.Arguments))
+	for k := range d.Arguments {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	s := d.Driver
+	for _, k := range keys {
+		s += fmt.Sprintf(",%s=%v", k, d.Arguments[k])
+	}
+	return s
+}
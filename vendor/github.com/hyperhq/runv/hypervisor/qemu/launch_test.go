@@ -0,0 +1,67 @@
+// +build linux
+
+package qemu
+
+import "testing"
+
+func TestMachineArgAppendsNvdimmArgsWhenPresent(t *testing.T) {
+	want := "q35,nvdimm=on,maxmem=65536M"
+	if got := machineArg("q35", "nvdimm=on,maxmem=65536M"); got != want {
+		t.Errorf("machineArg(...) = %q, want %q", got, want)
+	}
+}
+
+func TestMachineArgLeavesBaseAloneWhenNvdimmUnsupported(t *testing.T) {
+	if got := machineArg("pseries", ""); got != "pseries" {
+		t.Errorf("machineArg(...) = %q, want %q", got, "pseries")
+	}
+}
+
+func TestBridgeDeviceArg(t *testing.T) {
+	b := Bridge{Id: "pcie.0", Driver: "gpex-pcihost", Bus: "pcie.0"}
+	want := "gpex-pcihost,id=pcie.0,bus=pcie.0"
+	if got := bridgeDeviceArg(b); got != want {
+		t.Errorf("bridgeDeviceArg(%+v) = %q, want %q", b, got, want)
+	}
+}
+
+func TestDefaultDeviceArgOrdersArgumentsDeterministically(t *testing.T) {
+	d := Device{
+		Driver: "virtio-gpu-pci",
+		Arguments: map[string]interface{}{
+			"max_outputs": 1,
+			"bus":         "pcie.0",
+		},
+	}
+	want := "virtio-gpu-pci,bus=pcie.0,max_outputs=1"
+	if got := defaultDeviceArg(d); got != want {
+		t.Errorf("defaultDeviceArg(%+v) = %q, want %q", d, got, want)
+	}
+}
+
+func TestDefaultDeviceArgWithNoArguments(t *testing.T) {
+	d := Device{Driver: "virtio-gpu-pci"}
+	if got := defaultDeviceArg(d); got != "virtio-gpu-pci" {
+		t.Errorf("defaultDeviceArg(%+v) = %q, want %q", d, got, "virtio-gpu-pci")
+	}
+}
+
+func TestDeviceArgsCoversBridgesThenDefaultDevices(t *testing.T) {
+	bridges := []Bridge{{Id: "pcie.0", Driver: "gpex-pcihost", Bus: "pcie.0"}}
+	defaultDevices := []Device{{Driver: "virtio-gpu-pci"}}
+
+	args := deviceArgs(bridges, defaultDevices)
+
+	want := []string{
+		"-device", "gpex-pcihost,id=pcie.0,bus=pcie.0",
+		"-device", "virtio-gpu-pci",
+	}
+	if len(args) != len(want) {
+		t.Fatalf("deviceArgs = %v, want %v", args, want)
+	}
+	for i := range want {
+		if args[i] != want[i] {
+			t.Errorf("deviceArgs[%d] = %q, want %q", i, args[i], want[i])
+		}
+	}
+}
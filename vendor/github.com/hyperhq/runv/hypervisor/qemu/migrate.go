@@ -0,0 +1,245 @@
+// +build linux
+
+package qemu
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/hyperhq/runv/hypervisor"
+)
+
+// MigrateOptions controls the capabilities and tuning parameters used for an
+// outbound live migration started with Migrate().
+type MigrateOptions struct {
+	Xbzrle       bool
+	AutoConverge bool
+	PostcopyRam  bool
+	Compress     bool
+
+	// MaxSpeedBps and MaxDowntimeMs are optional; zero leaves qemu's default.
+	MaxSpeedBps   int64
+	MaxDowntimeMs int64
+}
+
+// MigrationStatus mirrors the "status" field of a QMP query-migrate reply.
+type MigrationStatus string
+
+const (
+	MigrationStatusSetup    MigrationStatus = "setup"
+	MigrationStatusActive   MigrationStatus = "active"
+	MigrationStatusComplete MigrationStatus = "completed"
+	MigrationStatusFailed   MigrationStatus = "failed"
+	MigrationStatusCanceled MigrationStatus = "cancelled"
+)
+
+// MigrationProgress is one sample of live migration progress, as streamed by
+// Migrate() on the channel it returns.
+type MigrationProgress struct {
+	Status           MigrationStatus
+	TotalBytes       uint64
+	TransferredBytes uint64
+	RemainingBytes   uint64
+	DirtyRate        uint64
+	Downtime         uint64
+}
+
+func (s MigrationStatus) terminal() bool {
+	return s == MigrationStatusComplete || s == MigrationStatusFailed || s == MigrationStatusCanceled
+}
+
+const migrateQueryInterval = 1 * time.Second
+
+// incomingPollInterval is how often waitIncoming checks whether a sandbox
+// launched with "-incoming" has finished receiving its migration.
+const incomingPollInterval = 1 * time.Second
+
+// waitIncoming polls query-status until the sandbox's qemu process stops
+// reporting the "inmigrate" state, i.e. until the peer runv that started
+// Migrate() has finished handing the sandbox off to this one. It logs the
+// outcome; callers that need to act on completion should watch Events()
+// for a MIGRATION event instead.
+func (qc *QemuContext) waitIncoming(ctx *hypervisor.VmContext) {
+	ticker := time.NewTicker(incomingPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		status, err := qc.qmpQueryTimeout(ctx, "query-status", nil, watchdogQueryTimeout)
+		if err != nil {
+			glog.V(1).Infof("waitIncoming: sandbox %s query-status failed, retrying: %v", ctx.Id, err)
+			continue
+		}
+		if asString(status["status"]) != "inmigrate" {
+			glog.Infof("sandbox %s finished receiving incoming migration from %s", ctx.Id, qc.incomingURI)
+			return
+		}
+	}
+}
+
+// Migrate starts an outbound live migration of the sandbox to uri (a qemu
+// migration URI, e.g. "tcp:host:port", "unix:/path/to/sock" or
+// "exec:cmd"), and returns a channel of MigrationProgress events that is
+// closed once the migration reaches a terminal status.
+func (qc *QemuContext) Migrate(ctx *hypervisor.VmContext, uri string, opts MigrateOptions) (<-chan MigrationProgress, error) {
+	if err := qc.migrateSetCapabilities(ctx, opts); err != nil {
+		return nil, err
+	}
+	if err := qc.migrateSetParameters(ctx, opts); err != nil {
+		return nil, err
+	}
+
+	result := make(chan error, 1)
+	qc.qmpSend(ctx, &QmpSession{
+		commands: []*QmpCommand{{
+			Execute:   "migrate",
+			Arguments: map[string]interface{}{"uri": uri},
+		}},
+		respond: func(err error) { result <- err },
+	})
+	if err := <-result; err != nil {
+		return nil, fmt.Errorf("failed to start migration to %s: %v", uri, err)
+	}
+
+	progress := make(chan MigrationProgress, 1)
+	go qc.watchMigration(ctx, progress)
+	return progress, nil
+}
+
+func (qc *QemuContext) migrateSetCapabilities(ctx *hypervisor.VmContext, opts MigrateOptions) error {
+	caps := []map[string]interface{}{
+		{"capability": "xbzrle", "state": opts.Xbzrle},
+		{"capability": "auto-converge", "state": opts.AutoConverge},
+		{"capability": "postcopy-ram", "state": opts.PostcopyRam},
+		{"capability": "compress", "state": opts.Compress},
+	}
+
+	result := make(chan error, 1)
+	qc.qmpSend(ctx, &QmpSession{
+		commands: []*QmpCommand{{
+			Execute:   "migrate-set-capabilities",
+			Arguments: map[string]interface{}{"capabilities": caps},
+		}},
+		respond: func(err error) { result <- err },
+	})
+	return <-result
+}
+
+func (qc *QemuContext) migrateSetParameters(ctx *hypervisor.VmContext, opts MigrateOptions) error {
+	params := map[string]interface{}{}
+	if opts.MaxSpeedBps > 0 {
+		params["max-bandwidth"] = opts.MaxSpeedBps
+	}
+	if opts.MaxDowntimeMs > 0 {
+		params["downtime-limit"] = opts.MaxDowntimeMs
+	}
+	if len(params) == 0 {
+		return nil
+	}
+
+	result := make(chan error, 1)
+	qc.qmpSend(ctx, &QmpSession{
+		commands: []*QmpCommand{{
+			Execute:   "migrate-set-parameters",
+			Arguments: params,
+		}},
+		respond: func(err error) { result <- err },
+	})
+	return <-result
+}
+
+// MigrateCancel aborts an in-flight migration started by Migrate().
+func (qc *QemuContext) MigrateCancel(ctx *hypervisor.VmContext) error {
+	result := make(chan error, 1)
+	qc.qmpSend(ctx, &QmpSession{
+		commands: []*QmpCommand{{Execute: "migrate_cancel"}},
+		respond:  func(err error) { result <- err },
+	})
+	return <-result
+}
+
+// MigrateSetSpeed adjusts the maximum migration bandwidth, in bytes/sec, of
+// an in-flight or future migration.
+func (qc *QemuContext) MigrateSetSpeed(ctx *hypervisor.VmContext, bytesPerSec int64) error {
+	result := make(chan error, 1)
+	qc.qmpSend(ctx, &QmpSession{
+		commands: []*QmpCommand{{
+			Execute:   "migrate-set-parameters",
+			Arguments: map[string]interface{}{"max-bandwidth": bytesPerSec},
+		}},
+		respond: func(err error) { result <- err },
+	})
+	return <-result
+}
+
+// MigrateSetDowntime adjusts the acceptable migration downtime, in
+// milliseconds, of an in-flight or future migration.
+func (qc *QemuContext) MigrateSetDowntime(ctx *hypervisor.VmContext, ms int64) error {
+	result := make(chan error, 1)
+	qc.qmpSend(ctx, &QmpSession{
+		commands: []*QmpCommand{{
+			Execute:   "migrate-set-parameters",
+			Arguments: map[string]interface{}{"downtime-limit": ms},
+		}},
+		respond: func(err error) { result <- err },
+	})
+	return <-result
+}
+
+// watchMigration polls query-migrate on migrateQueryInterval and streams a
+// MigrationProgress on progress for each sample, until status is completed,
+// failed, or cancelled.
+func (qc *QemuContext) watchMigration(ctx *hypervisor.VmContext, progress chan<- MigrationProgress) {
+	defer close(progress)
+
+	ticker := time.NewTicker(migrateQueryInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		reply, err := qc.qmpQuery(ctx, "query-migrate", nil)
+		if err != nil {
+			glog.Errorf("query-migrate failed for sandbox %s: %v", ctx.Id, err)
+			progress <- MigrationProgress{Status: MigrationStatusFailed}
+			return
+		}
+
+		p := parseMigrateReply(reply)
+		progress <- p
+		if p.Status.terminal() {
+			return
+		}
+	}
+}
+
+func parseMigrateReply(reply map[string]interface{}) MigrationProgress {
+	p := MigrationProgress{Status: MigrationStatus(asString(reply["status"]))}
+
+	ram, _ := reply["ram"].(map[string]interface{})
+	p.TotalBytes = asUint64(ram["total"])
+	p.TransferredBytes = asUint64(ram["transferred"])
+	p.RemainingBytes = asUint64(ram["remaining"])
+	p.DirtyRate = asUint64(ram["dirty-pages-rate"])
+	p.Downtime = asUint64(reply["downtime"])
+	return p
+}
+
+func asString(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+func asUint64(v interface{}) uint64 {
+	switch n := v.(type) {
+	case float64:
+		return uint64(n)
+	case int64:
+		return uint64(n)
+	default:
+		return 0
+	}
+}
+
+func asBool(v interface{}) bool {
+	b, _ := v.(bool)
+	return b
+}
@@ -0,0 +1,77 @@
+// +build linux
+
+package qemu
+
+import "testing"
+
+func TestParseMigrateReply(t *testing.T) {
+	reply := map[string]interface{}{
+		"status": "active",
+		"ram": map[string]interface{}{
+			"total":            float64(1 << 30),
+			"transferred":      float64(1 << 20),
+			"remaining":        float64((1 << 30) - (1 << 20)),
+			"dirty-pages-rate": float64(42),
+		},
+		"downtime": float64(12),
+	}
+
+	p := parseMigrateReply(reply)
+	if p.Status != MigrationStatusActive {
+		t.Fatalf("p.Status = %q, want %q", p.Status, MigrationStatusActive)
+	}
+	if p.TotalBytes != 1<<30 {
+		t.Fatalf("p.TotalBytes = %d, want %d", p.TotalBytes, 1<<30)
+	}
+	if p.TransferredBytes != 1<<20 {
+		t.Fatalf("p.TransferredBytes = %d, want %d", p.TransferredBytes, 1<<20)
+	}
+	if p.DirtyRate != 42 {
+		t.Fatalf("p.DirtyRate = %d, want 42", p.DirtyRate)
+	}
+	if p.Downtime != 12 {
+		t.Fatalf("p.Downtime = %d, want 12", p.Downtime)
+	}
+}
+
+func TestMigrationStatusTerminal(t *testing.T) {
+	cases := map[MigrationStatus]bool{
+		MigrationStatusSetup:    false,
+		MigrationStatusActive:   false,
+		MigrationStatusComplete: true,
+		MigrationStatusFailed:   true,
+		MigrationStatusCanceled: true,
+	}
+	for status, want := range cases {
+		if got := status.terminal(); got != want {
+			t.Errorf("%q.terminal() = %v, want %v", status, got, want)
+		}
+	}
+}
+
+func TestAsUint64(t *testing.T) {
+	cases := []struct {
+		in   interface{}
+		want uint64
+	}{
+		{float64(42), 42},
+		{int64(7), 7},
+		{"not a number", 0},
+		{nil, 0},
+		{true, 0},
+	}
+	for _, c := range cases {
+		if got := asUint64(c.in); got != c.want {
+			t.Errorf("asUint64(%#v) = %d, want %d", c.in, got, c.want)
+		}
+	}
+}
+
+func TestAsString(t *testing.T) {
+	if got := asString("hello"); got != "hello" {
+		t.Errorf("asString(%q) = %q, want %q", "hello", got, "hello")
+	}
+	if got := asString(42); got != "" {
+		t.Errorf("asString(42) = %q, want empty string", got)
+	}
+}
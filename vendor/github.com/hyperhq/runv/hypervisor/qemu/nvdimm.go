@@ -0,0 +1,173 @@
+// +build linux
+
+package qemu
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/golang/glog"
+	"github.com/hyperhq/runv/hypervisor"
+)
+
+// maxNvdimmSlots bounds how many DAX volumes a sandbox may attach; it sizes
+// the "-machine <machine>,nvdimm=on,maxmem=..." launchQemu must pass so qemu
+// reserves enough address space for every slot this package might hotplug.
+const maxNvdimmSlots = 16
+
+// nvdimmMaxMemMB is the maxmem value NvdimmMachineArgs passes when any disk
+// may be attached with DAX, sized for maxNvdimmSlots slots of up to 4GB
+// each. The guest's boot memory is not added to it.
+const nvdimmMaxMemMB = maxNvdimmSlots * 4096
+
+// isDaxBlock reports whether blockInfo asks to be attached as a DAX-capable
+// pmem region (backed by memory-backend-file + nvdimm) instead of a regular
+// virtio-blk/scsi disk, letting image layers be mmap'd directly from host
+// page cache without duplicating them per sandbox.
+func isDaxBlock(blockInfo *hypervisor.DiskDescriptor) bool {
+	if blockInfo.DaxBlock {
+		return true
+	}
+	return blockInfo.Options != nil && blockInfo.Options["dax"] == "true"
+}
+
+// NvdimmMachineArgs returns the "-machine" suffix launchQemu must append
+// whenever nvdimm may be used, enabling nvdimm support and reserving
+// maxmem room for maxNvdimmSlots hotplugged pmem regions.
+func NvdimmMachineArgs() string {
+	return fmt.Sprintf("nvdimm=on,maxmem=%dM", nvdimmMaxMemMB)
+}
+
+// reserveNvdimmSlot hands out the smallest nvdimm slot index not already held
+// by another id, mirroring the way AddMem's caller tracks dimm slots for
+// memory hotplug. Deriving the slot from len(qc.nvdimmSlots) would collide
+// once slots are released and reserved again out of order (reserve A->0,
+// reserve B->1, release A, reserve C->len()==1 clashes with B's still-live
+// slot 1), so scan for the first index below maxNvdimmSlots that's free
+// instead. It fails once maxNvdimmSlots are in use.
+func (qc *QemuContext) reserveNvdimmSlot(id string) (int, error) {
+	if qc.nvdimmSlots == nil {
+		qc.nvdimmSlots = make(map[string]int)
+	}
+	if len(qc.nvdimmSlots) >= maxNvdimmSlots {
+		return 0, fmt.Errorf("no free nvdimm slots: %d already in use", maxNvdimmSlots)
+	}
+
+	used := make(map[int]bool, len(qc.nvdimmSlots))
+	for _, slot := range qc.nvdimmSlots {
+		used[slot] = true
+	}
+	for slot := 0; slot < maxNvdimmSlots; slot++ {
+		if !used[slot] {
+			qc.nvdimmSlots[id] = slot
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("no free nvdimm slots: %d already in use", maxNvdimmSlots)
+}
+
+// releaseNvdimmSlot forgets id's nvdimm slot, returning it and true if id
+// was in fact attached as an nvdimm device.
+func (qc *QemuContext) releaseNvdimmSlot(id string) (int, bool) {
+	slot, ok := qc.nvdimmSlots[id]
+	if ok {
+		delete(qc.nvdimmSlots, id)
+	}
+	return slot, ok
+}
+
+// newNvdimmAddSession attaches blockInfo's image as a memory-backend-file +
+// nvdimm pair, exposing it to the guest as a DAX-capable pmem region so the
+// image layer can be mmap'd directly from host page cache instead of being
+// duplicated per sandbox.
+func newNvdimmAddSession(ctx *hypervisor.VmContext, qc *QemuContext, blockInfo *hypervisor.DiskDescriptor, slot int, result chan<- hypervisor.VmEvent) {
+	size, err := diskSizeBytes(blockInfo.Filename)
+	if err != nil {
+		glog.Errorf("failed to size nvdimm-backed disk %s for sandbox %s: %v", blockInfo.Filename, ctx.Id, err)
+		result <- &hypervisor.DeviceFailed{Session: nil}
+		return
+	}
+
+	memdev := "nvdimmmem" + strconv.Itoa(slot)
+	dev := "nvdimm" + strconv.Itoa(slot)
+
+	commands := []*QmpCommand{
+		{
+			Execute: "object-add",
+			Arguments: map[string]interface{}{
+				"qom-type": "memory-backend-file",
+				"id":       memdev,
+				"props": map[string]interface{}{
+					"mem-path": blockInfo.Filename,
+					"size":     size,
+					"share":    true,
+				},
+			},
+		},
+		{
+			Execute: "device_add",
+			Arguments: map[string]interface{}{
+				"driver":  "nvdimm",
+				"id":      dev,
+				"memdev":  memdev,
+				"unarmed": blockInfo.ReadOnly,
+			},
+		},
+	}
+
+	qc.qmpSend(ctx, &QmpSession{
+		commands: commands,
+		respond: func(err error) {
+			if err != nil {
+				glog.Errorf("failed to attach nvdimm disk %s for sandbox %s: %v", blockInfo.Filename, ctx.Id, err)
+				result <- &hypervisor.DeviceFailed{Session: nil}
+				return
+			}
+			result <- &hypervisor.BlockdevInsertedEvent{
+				DeviceName: dev,
+				SourceType: "nvdimm",
+			}
+		},
+	})
+}
+
+// newNvdimmDelSession tears down the nvdimm device and its backing
+// memory-backend-file created by newNvdimmAddSession for slot.
+func newNvdimmDelSession(ctx *hypervisor.VmContext, qc *QemuContext, slot int, callback hypervisor.VmEvent, result chan<- hypervisor.VmEvent) {
+	memdev := "nvdimmmem" + strconv.Itoa(slot)
+	dev := "nvdimm" + strconv.Itoa(slot)
+
+	commands := []*QmpCommand{
+		{
+			Execute:   "device_del",
+			Arguments: map[string]interface{}{"id": dev},
+		},
+		{
+			Execute:   "object_del",
+			Arguments: map[string]interface{}{"id": memdev},
+		},
+	}
+
+	qc.qmpSend(ctx, &QmpSession{
+		commands: commands,
+		respond: func(err error) {
+			if err != nil {
+				glog.Errorf("failed to detach nvdimm device %s for sandbox %s: %v", dev, ctx.Id, err)
+				result <- &hypervisor.DeviceFailed{Session: nil}
+				return
+			}
+			result <- callback
+		},
+	})
+}
+
+// diskSizeBytes stats filename to get the size to hand memory-backend-file,
+// which mmaps exactly "size" bytes of it.
+func diskSizeBytes(filename string) (int64, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
@@ -0,0 +1,106 @@
+// +build linux
+
+package qemu
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReserveNvdimmSlotAssignsIncreasingSlots(t *testing.T) {
+	qc := &QemuContext{}
+
+	for i := 0; i < maxNvdimmSlots; i++ {
+		slot, err := qc.reserveNvdimmSlot(string(rune('a' + i)))
+		if err != nil {
+			t.Fatalf("reserveNvdimmSlot(%d) returned unexpected error: %v", i, err)
+		}
+		if slot != i {
+			t.Fatalf("reserveNvdimmSlot(%d) = %d, want %d", i, slot, i)
+		}
+	}
+
+	if _, err := qc.reserveNvdimmSlot("one-too-many"); err == nil {
+		t.Fatal("reserveNvdimmSlot should fail once maxNvdimmSlots are in use")
+	}
+}
+
+func TestReleaseNvdimmSlotFreesItForReuse(t *testing.T) {
+	qc := &QemuContext{}
+
+	slot, err := qc.reserveNvdimmSlot("disk0")
+	if err != nil {
+		t.Fatalf("reserveNvdimmSlot: %v", err)
+	}
+
+	if got, ok := qc.releaseNvdimmSlot("disk0"); !ok || got != slot {
+		t.Fatalf("releaseNvdimmSlot(disk0) = (%d, %v), want (%d, true)", got, ok, slot)
+	}
+	if _, ok := qc.releaseNvdimmSlot("disk0"); ok {
+		t.Fatal("releaseNvdimmSlot should report false once the slot is already released")
+	}
+}
+
+func TestReserveNvdimmSlotDoesNotCollideWithLiveSibling(t *testing.T) {
+	qc := &QemuContext{}
+
+	slotA, err := qc.reserveNvdimmSlot("disk-a")
+	if err != nil {
+		t.Fatalf("reserveNvdimmSlot(disk-a): %v", err)
+	}
+	slotB, err := qc.reserveNvdimmSlot("disk-b")
+	if err != nil {
+		t.Fatalf("reserveNvdimmSlot(disk-b): %v", err)
+	}
+
+	if _, ok := qc.releaseNvdimmSlot("disk-a"); !ok {
+		t.Fatal("releaseNvdimmSlot(disk-a) should report true")
+	}
+
+	slotC, err := qc.reserveNvdimmSlot("disk-c")
+	if err != nil {
+		t.Fatalf("reserveNvdimmSlot(disk-c): %v", err)
+	}
+	if slotC != slotA {
+		t.Fatalf("reserveNvdimmSlot(disk-c) = %d, want the freed slot %d", slotC, slotA)
+	}
+	if slotC == slotB {
+		t.Fatalf("reserveNvdimmSlot(disk-c) = %d, collides with disk-b's still-live slot %d", slotC, slotB)
+	}
+}
+
+func TestDiskSizeBytes(t *testing.T) {
+	f, err := ioutil.TempFile("", "nvdimm-test")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(make([]byte, 4096)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	f.Close()
+
+	size, err := diskSizeBytes(f.Name())
+	if err != nil {
+		t.Fatalf("diskSizeBytes: %v", err)
+	}
+	if size != 4096 {
+		t.Fatalf("diskSizeBytes = %d, want 4096", size)
+	}
+}
+
+func TestNvdimmMachineArgsIncludesMaxmem(t *testing.T) {
+	args := NvdimmMachineArgs()
+	if args == "" {
+		t.Fatal("NvdimmMachineArgs must not be empty")
+	}
+	if want := "nvdimm=on,maxmem="; !containsPrefix(args, want) {
+		t.Fatalf("NvdimmMachineArgs() = %q, want prefix %q", args, want)
+	}
+}
+
+func containsPrefix(s, prefix string) bool {
+	return len(s) >= len(prefix) && s[:len(prefix)] == prefix
+}
@@ -9,19 +9,20 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strconv"
+	"runtime"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/hyperhq/runv/hypervisor"
-	"github.com/hyperhq/runv/hypervisor/types"
 )
 
 //implement the hypervisor.HypervisorDriver interface
 type QemuDriver struct {
 	executable string
 	hasVsock   bool
+	arch       QemuArch
 }
 
 //implement the hypervisor.DriverContext interface
@@ -30,11 +31,67 @@ type QemuContext struct {
 	qmp         chan QmpInteraction
 	waitQmp     chan int
 	wdt         chan string
+	homeDir     string
 	qmpSockName string
 	qemuPidFile string
 	qemuLogFile *QemuLogFile
 	cpus        int
 	process     *os.Process
+
+	// nvdimmSlots tracks which ScsiId has been attached as a DAX-backed
+	// nvdimm device, keyed to the nvdimm/memdev slot index it was given; see
+	// AddDisk/RemoveDisk and nvdimm.go.
+	nvdimmSlots map[string]int
+
+	// nicDevices tracks the host tap device backing each nic added via
+	// AddNic, keyed by its tap file descriptor so RemoveNic (which only
+	// gets that fd back, via InterfaceCreated.TapFd) can forget it again.
+	// Stats() reads /sys/class/net/<device>/statistics/* for every entry
+	// to fill in per-nic counters; see stats.go.
+	nicDevices map[int]string
+
+	// nvdimmMachineArgs is set by Launch() when qc.driver.arch supports
+	// nvdimm, and is appended onto qc.machine's "-machine" value by
+	// launchQemu's qemuArgs so qemu reserves room for DAX-backed disks added
+	// later via AddDisk.
+	nvdimmMachineArgs string
+
+	// machine, cpuModel, bridges and defaultDevices are computed from
+	// qc.driver.arch by Launch(), replacing the amd64-only hardcoded
+	// "-machine"/"-cpu"/bridge/device flags launchQemu used to build:
+	// launchQemu passes "-machine "+qc.machine and "-cpu "+qc.cpuModel, and
+	// adds a "-device" for every entry in qc.bridges and qc.defaultDevices.
+	machine        string
+	cpuModel       string
+	bridges        []Bridge
+	defaultDevices []Device
+
+	// incomingURI is set by InitIncomingContext before Launch() so that
+	// launchQemu() can start qemu with "-incoming <incomingURI>" to receive a
+	// live migration handed off by a peer runv instead of booting a new guest.
+	// Launch() also starts waitIncoming() whenever this is non-empty, to
+	// notice when the hand-off has completed; see migrate.go.
+	incomingURI string
+
+	// restoringSnapshot is set by InitRestoreContext before Launch() so the
+	// guest is rehydrated from a prior Snapshot instead of booting empty.
+	// For an external snapshot, InitRestoreContext also points incomingURI
+	// at the recorded memory-state file, reusing the same "-incoming" launch
+	// path as live migration; for an internal one, Launch() starts
+	// loadSnapshotAfterBoot to issue "loadvm" once QMP is up. See snapshot.go.
+	restoringSnapshot *Snapshot
+
+	// events carries decoded asynchronous QMP events to Events() subscribers,
+	// fed by runEventListener; eventsStop tells that goroutine to give up.
+	events     chan QmpEvent
+	eventsStop chan struct{}
+
+	// policy is what the watchdog goroutine does once it decides the guest
+	// is unresponsive; see events.go.
+	policy WatchdogPolicy
+
+	// statsCache memoizes Stats() for statsCacheTTL; see stats.go.
+	statsCache statsCache
 }
 
 func qemuContext(ctx *hypervisor.VmContext) *QemuContext {
@@ -56,6 +113,7 @@ func InitDriver() *QemuDriver {
 	return &QemuDriver{
 		executable: cmd,
 		hasVsock:   hasVsock,
+		arch:       archFor(runtime.GOARCH),
 	}
 }
 
@@ -82,11 +140,42 @@ func (qd *QemuDriver) InitContext(homeDir string) hypervisor.DriverContext {
 		qmp:         make(chan QmpInteraction, 128),
 		wdt:         make(chan string, 16),
 		waitQmp:     make(chan int, 1),
+		homeDir:     homeDir,
 		qmpSockName: filepath.Join(homeDir, QmpSockName),
 		qemuPidFile: filepath.Join(homeDir, QemuPidFile),
 		qemuLogFile: qemuLogFile,
 		process:     nil,
+		events:      make(chan QmpEvent, 128),
+		eventsStop:  make(chan struct{}),
+		policy:      WatchdogKill,
+	}
+}
+
+// InitIncomingContext behaves like InitContext, but marks the resulting
+// context as the receiving end of a live migration: Launch() will start qemu
+// with "-incoming incomingURI" instead of booting a fresh guest, so a peer
+// runv can hand off a running sandbox with Migrate().
+func (qd *QemuDriver) InitIncomingContext(homeDir, incomingURI string) hypervisor.DriverContext {
+	dc := qd.InitContext(homeDir)
+	dc.(*QemuContext).incomingURI = incomingURI
+	return dc
+}
+
+// InitRestoreContext behaves like InitContext, but arranges for Launch() to
+// rehydrate the guest from snap instead of booting it empty. An external
+// snapshot streams its recorded memory-state file in via "-incoming", the
+// same launch-time mechanism InitIncomingContext uses for live migration
+// hand-off; an internal snapshot is restored with "loadvm" once QMP comes
+// up. Either way, the caller is responsible for attaching snap.DiskOverlays
+// (external) or the original disk images (internal) before Launch().
+func (qd *QemuDriver) InitRestoreContext(homeDir string, snap *Snapshot) hypervisor.DriverContext {
+	dc := qd.InitContext(homeDir)
+	qc := dc.(*QemuContext)
+	qc.restoringSnapshot = snap
+	if snap.External {
+		qc.incomingURI = fmt.Sprintf("exec:cat %s", snap.MemoryState)
 	}
+	return dc
 }
 
 func (qd *QemuDriver) LoadContext(persisted map[string]interface{}) (hypervisor.DriverContext, error) {
@@ -94,6 +183,27 @@ func (qd *QemuDriver) LoadContext(persisted map[string]interface{}) (hypervisor.
 		return nil, errors.New("wrong driver type in persist info")
 	}
 
+	// A context persisted mid-restore (runv restarted before the snapshot
+	// finished loading) has no live qemu process to reconnect to; rebuild it
+	// via InitRestoreContext so Launch() resumes the restore instead of
+	// trying to attach to a pid that was never started.
+	if r, ok := persisted["restoringSnapshot"]; ok {
+		data, err := json.Marshal(r)
+		if err != nil {
+			return nil, fmt.Errorf("wrong restoringSnapshot field type in persist info: %v", err)
+		}
+		var snap Snapshot
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return nil, fmt.Errorf("wrong restoringSnapshot field type in persist info: %v", err)
+		}
+
+		homeDir, ok := persisted["homeDir"].(string)
+		if !ok {
+			return nil, errors.New("cannot read the home dir info from persist info")
+		}
+		return qd.InitRestoreContext(homeDir, &snap), nil
+	}
+
 	var sock string
 	var log QemuLogFile
 	var proc *os.Process = nil
@@ -148,21 +258,60 @@ func (qd *QemuDriver) LoadContext(persisted map[string]interface{}) (hypervisor.
 		qmpSockName: sock,
 		qemuLogFile: &log,
 		process:     proc,
+		events:      make(chan QmpEvent, 128),
+		eventsStop:  make(chan struct{}),
+		policy:      WatchdogKill,
 	}, nil
 }
 
 func (qc *QemuContext) Launch(ctx *hypervisor.VmContext) {
+	arch := qc.driver.arch
+	qc.machine = arch.Machine()
+	qc.cpuModel = arch.CPUModel()
+	qc.bridges = arch.Bridges()
+	qc.defaultDevices = arch.DefaultDevices()
+	if arch.SupportsNvdimm() {
+		qc.nvdimmMachineArgs = NvdimmMachineArgs()
+	}
 	go launchQemu(qc, ctx)
 	go qmpHandler(ctx)
+	go qc.watchdog(ctx)
+	go qc.runEventListener(ctx)
+	if qc.incomingURI != "" {
+		go qc.waitIncoming(ctx)
+	}
+	if qc.restoringSnapshot != nil && !qc.restoringSnapshot.External {
+		go qc.loadSnapshotAfterBoot(ctx, qc.restoringSnapshot.Name)
+	}
 }
 
 func (qc *QemuContext) Associate(ctx *hypervisor.VmContext) {
 	go associateQemu(ctx)
 	go qmpHandler(ctx)
+	go qc.watchdog(ctx)
+	go qc.runEventListener(ctx)
+}
+
+// SetWatchdogPolicy changes what the watchdog goroutine does once it
+// decides the guest is unresponsive. It must be called before Launch()/
+// Associate() to take effect; the default, set by InitContext, is
+// WatchdogKill.
+func (qc *QemuContext) SetWatchdogPolicy(policy WatchdogPolicy) {
+	qc.policy = policy
 }
 
 func (qc *QemuContext) Dump() (map[string]interface{}, error) {
 	if qc.process == nil {
+		// A restore that hasn't finished booting yet has no pid to persist;
+		// record enough to resume the restore via LoadContext/
+		// InitRestoreContext instead of failing the whole dump.
+		if qc.restoringSnapshot != nil {
+			return map[string]interface{}{
+				"hypervisor":        "qemu",
+				"homeDir":           qc.homeDir,
+				"restoringSnapshot": qc.restoringSnapshot,
+			}, nil
+		}
 		return nil, errors.New("can not serialize qemu context: no process running")
 	}
 
@@ -190,6 +339,79 @@ func (qc *QemuContext) qmpSend(ctx *hypervisor.VmContext, s QmpInteraction) {
 	}
 }
 
+// qmpQuery issues a single QMP query command and returns its decoded
+// "return" payload. Unlike qmpSend's QmpSession, which only reports
+// success/failure, this is for commands such as query-migrate or
+// query-memory-size-summary whose response body the caller needs to
+// inspect. Callers must not index the result by "return" again — it is
+// already unwrapped. Only use this for commands whose "return" payload is a
+// JSON object; for ones that return a JSON array, use qmpQueryList instead,
+// since a map can't represent that shape.
+func (qc *QemuContext) qmpQuery(ctx *hypervisor.VmContext, execute string, args map[string]interface{}) (map[string]interface{}, error) {
+	result := make(chan error, 1)
+	reply := make(map[string]interface{})
+	qc.qmpSend(ctx, &QmpSession{
+		commands: []*QmpCommand{{
+			Execute:   execute,
+			Arguments: args,
+		}},
+		respond: func(err error) { result <- err },
+		results: func(r map[string]interface{}) { reply = r },
+	})
+	if err := <-result; err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// qmpQueryList is qmpQuery for commands such as query-cpus-fast or
+// query-blockstats, whose "return" payload is a JSON array rather than an
+// object.
+func (qc *QemuContext) qmpQueryList(ctx *hypervisor.VmContext, execute string, args map[string]interface{}) ([]interface{}, error) {
+	result := make(chan error, 1)
+	var reply []interface{}
+	qc.qmpSend(ctx, &QmpSession{
+		commands: []*QmpCommand{{
+			Execute:   execute,
+			Arguments: args,
+		}},
+		respond:     func(err error) { result <- err },
+		listResults: func(r []interface{}) { reply = r },
+	})
+	if err := <-result; err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// qmpQueryTimeout is qmpQuery with a deadline: if no reply arrives within
+// timeout (e.g. the QMP connection is wedged and qmpHandler never answers),
+// it returns an error instead of blocking its caller forever. Callers such
+// as the watchdog, which exist specifically to notice an unresponsive qemu,
+// must use this instead of the plain qmpQuery.
+func (qc *QemuContext) qmpQueryTimeout(ctx *hypervisor.VmContext, execute string, args map[string]interface{}, timeout time.Duration) (map[string]interface{}, error) {
+	result := make(chan error, 1)
+	reply := make(map[string]interface{})
+	qc.qmpSend(ctx, &QmpSession{
+		commands: []*QmpCommand{{
+			Execute:   execute,
+			Arguments: args,
+		}},
+		respond: func(err error) { result <- err },
+		results: func(r map[string]interface{}) { reply = r },
+	})
+
+	select {
+	case err := <-result:
+		if err != nil {
+			return nil, err
+		}
+		return reply, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("qmp query %q timed out after %s", execute, timeout)
+	}
+}
+
 func (qc *QemuContext) Kill(ctx *hypervisor.VmContext) {
 	defer func() {
 		err := recover()
@@ -200,10 +422,6 @@ func (qc *QemuContext) Kill(ctx *hypervisor.VmContext) {
 	qc.wdt <- "kill"
 }
 
-func (qc *QemuContext) Stats(ctx *hypervisor.VmContext) (*types.PodStats, error) {
-	return nil, nil
-}
-
 func (qc *QemuContext) Close() {
 	qc.qmp <- &QmpQuit{}
 	qc.wdt <- "quit"
@@ -211,6 +429,7 @@ func (qc *QemuContext) Close() {
 	qc.qemuLogFile.Close()
 	close(qc.qmp)
 	close(qc.wdt)
+	close(qc.eventsStop)
 }
 
 func (qc *QemuContext) Pause(ctx *hypervisor.VmContext, pause bool) error {
@@ -237,6 +456,17 @@ func (qc *QemuContext) Pause(ctx *hypervisor.VmContext, pause bool) error {
 }
 
 func (qc *QemuContext) AddDisk(ctx *hypervisor.VmContext, sourceType string, blockInfo *hypervisor.DiskDescriptor, result chan<- hypervisor.VmEvent) {
+	if isDaxBlock(blockInfo) && qc.driver.arch.SupportsNvdimm() {
+		slot, err := qc.reserveNvdimmSlot(blockInfo.ScsiId)
+		if err != nil {
+			glog.Errorf("fail to add nvdimm disk for sandbox %s: %v", ctx.Id, err)
+			result <- &hypervisor.DeviceFailed{Session: nil}
+			return
+		}
+		newNvdimmAddSession(ctx, qc, blockInfo, slot, result)
+		return
+	}
+
 	filename := blockInfo.Filename
 	format := blockInfo.Format
 	id := blockInfo.ScsiId
@@ -262,12 +492,17 @@ func (qc *QemuContext) AddDisk(ctx *hypervisor.VmContext, sourceType string, blo
 		}
 	}
 
-	newDiskAddSession(ctx, qc, filename, format, id, readonly, result)
+	newDiskAddSession(ctx, qc, filename, format, id, qc.driver.arch.DiskDriver(id), readonly, result)
 }
 
 func (qc *QemuContext) RemoveDisk(ctx *hypervisor.VmContext, blockInfo *hypervisor.DiskDescriptor, callback hypervisor.VmEvent, result chan<- hypervisor.VmEvent) {
 	id := blockInfo.ScsiId
 
+	if slot, ok := qc.releaseNvdimmSlot(id); ok {
+		newNvdimmDelSession(ctx, qc, slot, callback, result)
+		return
+	}
+
 	newDiskDelSession(ctx, qc, id, callback, result)
 }
 
@@ -292,6 +527,13 @@ func (qc *QemuContext) AddNic(ctx *hypervisor.VmContext, host *hypervisor.HostNi
 		return
 	}
 
+	if fd >= 0 {
+		if qc.nicDevices == nil {
+			qc.nicDevices = make(map[int]string)
+		}
+		qc.nicDevices[fd] = host.Device
+	}
+
 	go func() {
 		// close tap file if necessary
 		ev, ok := <-waitChan
@@ -305,10 +547,11 @@ func (qc *QemuContext) AddNic(ctx *hypervisor.VmContext, host *hypervisor.HostNi
 			result <- ev
 		}
 	}()
-	newNetworkAddSession(ctx, qc, fd, host, guest, waitChan)
+	newNetworkAddSession(ctx, qc, fd, qc.driver.arch.NicDriver(), host, guest, waitChan)
 }
 
 func (qc *QemuContext) RemoveNic(ctx *hypervisor.VmContext, n *hypervisor.InterfaceCreated, callback hypervisor.VmEvent, result chan<- hypervisor.VmEvent) {
+	delete(qc.nicDevices, n.TapFd)
 	syscall.Close(n.TapFd)
 	newNetworkDelSession(ctx, qc, n.NewName, callback, result)
 }
@@ -322,14 +565,9 @@ func (qc *QemuContext) SetCpus(ctx *hypervisor.VmContext, cpus int) error {
 		return nil
 	}
 
-	commands := make([]*QmpCommand, cpus-currcpus)
+	var commands []*QmpCommand
 	for id := currcpus; id < cpus; id++ {
-		commands[id-currcpus] = &QmpCommand{
-			Execute: "cpu-add",
-			Arguments: map[string]interface{}{
-				"id": id,
-			},
-		}
+		commands = append(commands, qc.driver.arch.HotplugCPU(id)...)
 	}
 
 	result := make(chan error, 1)
@@ -346,23 +584,7 @@ func (qc *QemuContext) SetCpus(ctx *hypervisor.VmContext, cpus int) error {
 }
 
 func (qc *QemuContext) AddMem(ctx *hypervisor.VmContext, slot, size int) error {
-	commands := make([]*QmpCommand, 2)
-	commands[0] = &QmpCommand{
-		Execute: "object-add",
-		Arguments: map[string]interface{}{
-			"qom-type": "memory-backend-ram",
-			"id":       "mem" + strconv.Itoa(slot),
-			"props":    map[string]interface{}{"size": int64(size) << 20},
-		},
-	}
-	commands[1] = &QmpCommand{
-		Execute: "device_add",
-		Arguments: map[string]interface{}{
-			"driver": "pc-dimm",
-			"id":     "dimm" + strconv.Itoa(slot),
-			"memdev": "mem" + strconv.Itoa(slot),
-		},
-	}
+	commands := qc.driver.arch.HotplugMemory(slot, size)
 	result := make(chan error, 1)
 	qc.qmpSend(ctx, &QmpSession{
 		commands: commands,
@@ -396,7 +618,9 @@ func (qc *QemuContext) Save(ctx *hypervisor.VmContext, path string) error {
 	}
 
 	result := make(chan error, 1)
-	// TODO: use query-migrate to query until completed
+	// Save() only ever targets a local file for templating, so a fire-and-forget
+	// migrate is fine here; see Migrate() for the general, progress-tracked path
+	// used for outbound live migration to a peer hypervisor.
 	qc.qmpSend(ctx, &QmpSession{
 		commands: commands,
 		respond:  func(err error) { result <- err },
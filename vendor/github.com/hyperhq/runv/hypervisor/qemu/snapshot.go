@@ -0,0 +1,254 @@
+// +build linux
+
+package qemu
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/hyperhq/runv/hypervisor"
+)
+
+const snapshotsDir = "snapshots"
+
+// Snapshot describes a point-in-time checkpoint of a sandbox, as recorded by
+// QemuContext.Snapshot and consumed by RestoreSnapshot/LoadContext.
+type Snapshot struct {
+	Name     string `json:"name"`
+	External bool   `json:"external"`
+
+	// MemoryState is the file holding "migrate exec:cat>..." guest RAM/device
+	// state, populated only for external snapshots. Internal snapshots carry
+	// RAM/device state inside the qcow2 image itself and are rehydrated via
+	// loadSnapshotAfterBoot's "loadvm" instead.
+	MemoryState string `json:"memoryState"`
+
+	// DiskOverlays maps a disk's ScsiId to its qcow2 overlay file, populated
+	// only for external snapshots.
+	DiskOverlays map[string]string `json:"diskOverlays,omitempty"`
+}
+
+func (qc *QemuContext) snapshotDir(ctx *hypervisor.VmContext, name string) string {
+	return filepath.Join(ctx.HomeDir, snapshotsDir, name)
+}
+
+// Snapshot checkpoints the running sandbox under name. When external is
+// false it uses qemu's internal savevm mechanism (guest RAM, device state
+// and disk contents all live inside the qcow2 image); when true it instead
+// drives blockdev-snapshot-sync to create a qcow2 overlay per attached disk
+// and dumps guest RAM/device state to a separate file, leaving the base
+// images untouched so they can be shared across sandboxes.
+func (qc *QemuContext) Snapshot(ctx *hypervisor.VmContext, name string, external bool) error {
+	if err := validateSnapshotName(name); err != nil {
+		return err
+	}
+
+	dir := qc.snapshotDir(ctx, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create snapshot dir %s: %v", dir, err)
+	}
+
+	snap := Snapshot{Name: name, External: external}
+
+	if external {
+		overlays, err := qc.snapshotExternal(ctx, dir)
+		if err != nil {
+			return err
+		}
+		snap.DiskOverlays = overlays
+
+		memPath := filepath.Join(dir, "memory.state")
+		if err := qc.dumpMemoryState(ctx, memPath); err != nil {
+			return err
+		}
+		snap.MemoryState = memPath
+	} else {
+		if err := qc.humanMonitorCommand(ctx, "savevm "+name); err != nil {
+			return fmt.Errorf("savevm %s failed: %v", name, err)
+		}
+	}
+
+	return qc.writeSnapshotMeta(dir, &snap)
+}
+
+// snapshotExternal issues blockdev-snapshot-sync for every attached disk,
+// returning a map of ScsiId to the qcow2 overlay file it was redirected to.
+func (qc *QemuContext) snapshotExternal(ctx *hypervisor.VmContext, dir string) (map[string]string, error) {
+	devices, err := qc.qmpQueryList(ctx, "query-block", nil)
+	if err != nil {
+		return nil, fmt.Errorf("query-block failed: %v", err)
+	}
+
+	overlays := make(map[string]string)
+	for device, overlay := range overlayPathsForDevices(dir, devices) {
+		result := make(chan error, 1)
+		qc.qmpSend(ctx, &QmpSession{
+			commands: []*QmpCommand{{
+				Execute: "blockdev-snapshot-sync",
+				Arguments: map[string]interface{}{
+					"device":        device,
+					"snapshot-file": overlay,
+					"format":        "qcow2",
+				},
+			}},
+			respond: func(err error) { result <- err },
+		})
+		if err := <-result; err != nil {
+			return nil, fmt.Errorf("blockdev-snapshot-sync for %s failed: %v", device, err)
+		}
+		overlays[device] = overlay
+	}
+	return overlays, nil
+}
+
+// overlayPathsForDevices takes the decoded reply from qmpQueryList("query-block",
+// ...), which already unwraps the QMP envelope's "return" field, and returns
+// the qcow2 overlay path snapshotExternal should redirect each attached disk
+// to. Split out from snapshotExternal so the device enumeration can be
+// exercised without a live QMP connection.
+func overlayPathsForDevices(dir string, devices []interface{}) map[string]string {
+	overlays := make(map[string]string)
+	for _, d := range devices {
+		m, ok := d.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		device := asString(m["device"])
+		if device == "" {
+			continue
+		}
+		overlays[device] = filepath.Join(dir, device+".qcow2")
+	}
+	return overlays
+}
+
+// dumpMemoryState streams guest RAM and device state to path via the same
+// "migrate exec:cat>" mechanism Save() uses for templating.
+func (qc *QemuContext) dumpMemoryState(ctx *hypervisor.VmContext, path string) error {
+	result := make(chan error, 1)
+	qc.qmpSend(ctx, &QmpSession{
+		commands: []*QmpCommand{{
+			Execute:   "migrate",
+			Arguments: map[string]interface{}{"uri": fmt.Sprintf("exec:cat>%s", path)},
+		}},
+		respond: func(err error) { result <- err },
+	})
+	return <-result
+}
+
+// humanMonitorCommand runs cmd through QMP's human-monitor-command
+// passthrough, for qemu functionality (savevm/loadvm/info snapshots) that
+// has no native QMP command on the qemu versions hyperd still supports.
+func (qc *QemuContext) humanMonitorCommand(ctx *hypervisor.VmContext, cmd string) error {
+	result := make(chan error, 1)
+	qc.qmpSend(ctx, &QmpSession{
+		commands: []*QmpCommand{{
+			Execute:   "human-monitor-command",
+			Arguments: map[string]interface{}{"command-line": cmd},
+		}},
+		respond: func(err error) { result <- err },
+	})
+	return <-result
+}
+
+func (qc *QemuContext) writeSnapshotMeta(dir string, snap *Snapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot metadata: %v", err)
+	}
+	metaPath := filepath.Join(dir, "snapshot.json")
+	if err := ioutil.WriteFile(metaPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write snapshot metadata %s: %v", metaPath, err)
+	}
+	return nil
+}
+
+// RestoreSnapshot reads back the metadata a prior Snapshot call recorded for
+// name under homeDir. Restoring a snapshot means relaunching qemu — either
+// with "-incoming" to stream in an external snapshot's memory-state file, or
+// booting normally and then issuing "loadvm" for an internal one — so the
+// caller is expected to pass the result to QemuDriver.InitRestoreContext
+// rather than apply it to an already-running QemuContext.
+func (qd *QemuDriver) RestoreSnapshot(homeDir, name string) (*Snapshot, error) {
+	if err := validateSnapshotName(name); err != nil {
+		return nil, err
+	}
+	return readSnapshotMeta(filepath.Join(homeDir, snapshotsDir, name))
+}
+
+const loadvmPollInterval = 1 * time.Second
+
+// loadSnapshotAfterBoot is started by Launch() for a context created with
+// InitRestoreContext against an internal snapshot. It polls query-status
+// until qemu's QMP monitor answers, then issues "loadvm name" to rehydrate
+// guest RAM/device state from the named internal snapshot.
+func (qc *QemuContext) loadSnapshotAfterBoot(ctx *hypervisor.VmContext, name string) {
+	ticker := time.NewTicker(loadvmPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := qc.qmpQueryTimeout(ctx, "query-status", nil, watchdogQueryTimeout); err != nil {
+			glog.V(1).Infof("loadSnapshotAfterBoot: sandbox %s not ready yet, retrying: %v", ctx.Id, err)
+			continue
+		}
+		if err := qc.humanMonitorCommand(ctx, "loadvm "+name); err != nil {
+			glog.Errorf("sandbox %s: loadvm %s failed: %v", ctx.Id, name, err)
+		}
+		return
+	}
+}
+
+func readSnapshotMeta(dir string) (*Snapshot, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "snapshot.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot metadata in %s: %v", dir, err)
+	}
+	var snap Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot metadata in %s: %v", dir, err)
+	}
+	return &snap, nil
+}
+
+// ListSnapshots returns the snapshots previously recorded by Snapshot for
+// this sandbox, ordered by snapshot name. Directories whose snapshot.json is
+// missing or unreadable are skipped.
+func (qc *QemuContext) ListSnapshots(ctx *hypervisor.VmContext) ([]Snapshot, error) {
+	base := filepath.Join(ctx.HomeDir, snapshotsDir)
+	entries, err := ioutil.ReadDir(base)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list snapshots dir %s: %v", base, err)
+	}
+
+	var snapshots []Snapshot
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		snap, err := readSnapshotMeta(filepath.Join(base, e.Name()))
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, *snap)
+	}
+	return snapshots, nil
+}
+
+var errSnapshotNameEmpty = errors.New("snapshot name must not be empty")
+
+func validateSnapshotName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return errSnapshotNameEmpty
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// +build linux
+
+package qemu
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotJSONRoundTrip(t *testing.T) {
+	want := Snapshot{
+		Name:        "before-upgrade",
+		External:    true,
+		MemoryState: "/var/lib/hyperd/vm-1/snapshots/before-upgrade/memory.state",
+		DiskOverlays: map[string]string{
+			"sda": "/var/lib/hyperd/vm-1/snapshots/before-upgrade/sda.qcow2",
+		},
+	}
+
+	data, err := json.Marshal(&want)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+
+	var got Snapshot
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+
+	if got.Name != want.Name || got.External != want.External || got.MemoryState != want.MemoryState {
+		t.Fatalf("round-tripped Snapshot = %+v, want %+v", got, want)
+	}
+	if got.DiskOverlays["sda"] != want.DiskOverlays["sda"] {
+		t.Fatalf("round-tripped DiskOverlays[\"sda\"] = %q, want %q", got.DiskOverlays["sda"], want.DiskOverlays["sda"])
+	}
+}
+
+func TestWriteAndReadSnapshotMeta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qemu-snapshot-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	qc := &QemuContext{}
+	snap := &Snapshot{Name: "checkpoint", External: false}
+	if err := qc.writeSnapshotMeta(dir, snap); err != nil {
+		t.Fatalf("writeSnapshotMeta failed: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "snapshot.json")); err != nil {
+		t.Fatalf("snapshot.json was not written: %v", err)
+	}
+
+	got, err := readSnapshotMeta(dir)
+	if err != nil {
+		t.Fatalf("readSnapshotMeta failed: %v", err)
+	}
+	if got.Name != snap.Name || got.External != snap.External {
+		t.Fatalf("readSnapshotMeta = %+v, want %+v", got, snap)
+	}
+}
+
+func TestOverlayPathsForDevicesEnumeratesAttachedDisks(t *testing.T) {
+	// qmpQueryList already unwraps the QMP envelope, so devices here is the
+	// "return" array itself, not {"return": [...]}.
+	devices := []interface{}{
+		map[string]interface{}{"device": "sda"},
+		map[string]interface{}{"device": "sdb"},
+		map[string]interface{}{"device": ""},
+	}
+
+	overlays := overlayPathsForDevices("/snapshots/before-upgrade", devices)
+
+	if len(overlays) != 2 {
+		t.Fatalf("len(overlays) = %d, want 2", len(overlays))
+	}
+	if overlays["sda"] != "/snapshots/before-upgrade/sda.qcow2" {
+		t.Errorf("overlays[\"sda\"] = %q, want %q", overlays["sda"], "/snapshots/before-upgrade/sda.qcow2")
+	}
+	if overlays["sdb"] != "/snapshots/before-upgrade/sdb.qcow2" {
+		t.Errorf("overlays[\"sdb\"] = %q, want %q", overlays["sdb"], "/snapshots/before-upgrade/sdb.qcow2")
+	}
+}
+
+func TestValidateSnapshotName(t *testing.T) {
+	if err := validateSnapshotName(""); err != errSnapshotNameEmpty {
+		t.Errorf("validateSnapshotName(\"\") = %v, want errSnapshotNameEmpty", err)
+	}
+	if err := validateSnapshotName("   "); err != errSnapshotNameEmpty {
+		t.Errorf("validateSnapshotName(\"   \") = %v, want errSnapshotNameEmpty", err)
+	}
+	if err := validateSnapshotName("checkpoint-1"); err != nil {
+		t.Errorf("validateSnapshotName(\"checkpoint-1\") = %v, want nil", err)
+	}
+}
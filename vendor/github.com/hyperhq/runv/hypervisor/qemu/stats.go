@@ -0,0 +1,213 @@
+// +build linux
+
+package qemu
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/hyperhq/runv/hypervisor"
+	"github.com/hyperhq/runv/hypervisor/types"
+)
+
+// statsCacheTTL bounds how often Stats() actually talks to QMP and /proc;
+// kubelet-style pollers tend to call this once a second per sandbox, and
+// that's needless load when nothing has changed in the meantime.
+const statsCacheTTL = 1 * time.Second
+
+type statsCache struct {
+	sync.Mutex
+	at    time.Time
+	stats *types.PodStats
+}
+
+// Stats gathers cpu/memory/block/network counters for the sandbox by
+// issuing a batch of QMP queries and reading /proc/<pid>/{stat,status} for
+// the qemu process itself. Results are cached for statsCacheTTL.
+func (qc *QemuContext) Stats(ctx *hypervisor.VmContext) (*types.PodStats, error) {
+	qc.statsCache.Lock()
+	defer qc.statsCache.Unlock()
+
+	if qc.statsCache.stats != nil && time.Since(qc.statsCache.at) < statsCacheTTL {
+		return qc.statsCache.stats, nil
+	}
+
+	stats := &types.PodStats{}
+
+	if qc.process != nil {
+		if err := readProcStats(qc.process.Pid, stats); err != nil {
+			return nil, fmt.Errorf("failed to read /proc stats for qemu pid %d: %v", qc.process.Pid, err)
+		}
+	}
+
+	cpus, err := qc.qmpQueryList(ctx, "query-cpus-fast", nil)
+	if err != nil {
+		return nil, fmt.Errorf("query-cpus-fast failed: %v", err)
+	}
+	fillCpuStats(stats, cpus)
+
+	mem, err := qc.qmpQuery(ctx, "query-memory-size-summary", nil)
+	if err != nil {
+		return nil, fmt.Errorf("query-memory-size-summary failed: %v", err)
+	}
+	fillMemoryStats(stats, mem)
+
+	block, err := qc.qmpQueryList(ctx, "query-blockstats", nil)
+	if err != nil {
+		return nil, fmt.Errorf("query-blockstats failed: %v", err)
+	}
+	fillBlockStats(stats, block)
+
+	// query-rx-filter only reports promiscuity/multicast/unicast filter
+	// state, not byte/packet counters, so per-nic traffic counters are read
+	// from the host tap devices tracked by AddNic/RemoveNic instead.
+	fillNetworkStats(stats, qc.nicDevices)
+
+	qc.statsCache.stats = stats
+	qc.statsCache.at = time.Now()
+	return stats, nil
+}
+
+// fillCpuStats, fillMemoryStats and fillBlockStats all take the decoded
+// reply from qmpQuery/qmpQueryList, which already unwraps the QMP
+// envelope's "return" field (see migrate.go's parseMigrateReply for the
+// same convention) — they must not index reply["return"] again.
+func fillCpuStats(stats *types.PodStats, cpus []interface{}) {
+	for _, c := range cpus {
+		m, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		stats.CpuStats = append(stats.CpuStats, types.CpuStats{
+			Cpu:    int(asUint64(m["cpu-index"])),
+			Thread: int(asUint64(m["thread-id"])),
+			Halted: asBool(m["halted"]),
+		})
+	}
+}
+
+func fillMemoryStats(stats *types.PodStats, reply map[string]interface{}) {
+	// set fields individually so RssBytes, filled earlier by readProcStats,
+	// is kept.
+	stats.MemoryStats.BaseMemoryBytes = asUint64(reply["base-memory"])
+	stats.MemoryStats.PluggedBytes = asUint64(reply["plugged-memory"])
+}
+
+func fillBlockStats(stats *types.PodStats, devices []interface{}) {
+	for _, d := range devices {
+		m, ok := d.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		device := asString(m["device"])
+		s, _ := m["stats"].(map[string]interface{})
+		stats.BlockStats = append(stats.BlockStats, types.BlockStats{
+			Device:     device,
+			ReadBytes:  asUint64(s["rd_bytes"]),
+			WriteBytes: asUint64(s["wr_bytes"]),
+			ReadOps:    asUint64(s["rd_operations"]),
+			WriteOps:   asUint64(s["wr_operations"]),
+		})
+	}
+}
+
+// fillNetworkStats reads per-nic rx/tx byte and packet counters straight
+// from the host tap devices in nicDevices (keyed by tap fd, see AddNic/
+// RemoveNic), since QMP has no command that reports them.
+func fillNetworkStats(stats *types.PodStats, nicDevices map[int]string) {
+	for _, device := range nicDevices {
+		n := types.NetworkStats{Name: device}
+		n.RxBytes, _ = readSysfsNetCounter(device, "rx_bytes")
+		n.TxBytes, _ = readSysfsNetCounter(device, "tx_bytes")
+		n.RxPackets, _ = readSysfsNetCounter(device, "rx_packets")
+		n.TxPackets, _ = readSysfsNetCounter(device, "tx_packets")
+		stats.NetworkStats = append(stats.NetworkStats, n)
+	}
+}
+
+func readSysfsNetCounter(device, counter string) (uint64, error) {
+	path := fmt.Sprintf("/sys/class/net/%s/statistics/%s", device, counter)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		glog.V(1).Infof("failed to read %s: %v", path, err)
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// readProcStats fills in process-level counters from /proc/<pid>/stat and
+// /proc/<pid>/status, since QMP has no notion of host RSS or scheduler time.
+func readProcStats(pid int, stats *types.PodStats) error {
+	utime, stime, err := readProcStat(pid)
+	if err != nil {
+		return err
+	}
+	stats.CpuUserTimeTicks = utime
+	stats.CpuSystemTimeTicks = stime
+
+	rss, err := readProcStatusRss(pid)
+	if err != nil {
+		return err
+	}
+	stats.MemoryStats.RssBytes = rss
+	return nil
+}
+
+func readProcStat(pid int) (utime, stime uint64, err error) {
+	return readProcStatFile(fmt.Sprintf("/proc/%d/stat", pid))
+}
+
+func readProcStatFile(path string) (utime, stime uint64, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// fields after the ")" that closes the process name are space
+	// separated and positionally fixed per proc(5); utime/stime are
+	// fields 14/15 (1-indexed) of the whole line.
+	i := strings.LastIndex(string(data), ")")
+	if i < 0 {
+		return 0, 0, fmt.Errorf("unexpected stat format in %s", path)
+	}
+	fields := strings.Fields(string(data)[i+2:])
+	if len(fields) < 13 {
+		return 0, 0, fmt.Errorf("unexpected stat format in %s", path)
+	}
+	utime, _ = strconv.ParseUint(fields[11], 10, 64)
+	stime, _ = strconv.ParseUint(fields[12], 10, 64)
+	return utime, stime, nil
+}
+
+func readProcStatusRss(pid int) (uint64, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "VmRSS:") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			break
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return kb << 10, nil
+	}
+	return 0, scanner.Err()
+}
@@ -0,0 +1,125 @@
+// +build linux
+
+package qemu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hyperhq/runv/hypervisor/types"
+)
+
+func TestFillCpuStatsReadsQmpQueryListShapedReply(t *testing.T) {
+	// qmpQueryList already unwraps the QMP envelope, so the reply here is
+	// the "return" array itself, not {"return": [...]}.
+	cpus := []interface{}{
+		map[string]interface{}{"cpu-index": float64(0), "thread-id": float64(1234), "halted": true},
+		map[string]interface{}{"cpu-index": float64(1), "thread-id": float64(1235), "halted": false},
+	}
+
+	stats := &types.PodStats{}
+	fillCpuStats(stats, cpus)
+
+	if len(stats.CpuStats) != 2 {
+		t.Fatalf("len(stats.CpuStats) = %d, want 2", len(stats.CpuStats))
+	}
+	if stats.CpuStats[0].Cpu != 0 || stats.CpuStats[0].Thread != 1234 || !stats.CpuStats[0].Halted {
+		t.Errorf("stats.CpuStats[0] = %+v, want Cpu=0 Thread=1234 Halted=true", stats.CpuStats[0])
+	}
+	if stats.CpuStats[1].Cpu != 1 || stats.CpuStats[1].Thread != 1235 || stats.CpuStats[1].Halted {
+		t.Errorf("stats.CpuStats[1] = %+v, want Cpu=1 Thread=1235 Halted=false", stats.CpuStats[1])
+	}
+}
+
+func TestFillMemoryStatsReadsQmpQueryShapedReply(t *testing.T) {
+	// qmpQuery already unwraps the QMP envelope, so the reply here is the
+	// "return" object itself, not {"return": {...}}.
+	reply := map[string]interface{}{
+		"base-memory":    float64(1 << 30),
+		"plugged-memory": float64(1 << 20),
+	}
+
+	stats := &types.PodStats{}
+	fillMemoryStats(stats, reply)
+
+	if stats.MemoryStats.BaseMemoryBytes != 1<<30 {
+		t.Errorf("BaseMemoryBytes = %d, want %d", stats.MemoryStats.BaseMemoryBytes, 1<<30)
+	}
+	if stats.MemoryStats.PluggedBytes != 1<<20 {
+		t.Errorf("PluggedBytes = %d, want %d", stats.MemoryStats.PluggedBytes, 1<<20)
+	}
+}
+
+func TestFillBlockStatsReadsQmpQueryListShapedReply(t *testing.T) {
+	devices := []interface{}{
+		map[string]interface{}{
+			"device": "drive0",
+			"stats": map[string]interface{}{
+				"rd_bytes":      float64(100),
+				"wr_bytes":      float64(200),
+				"rd_operations": float64(3),
+				"wr_operations": float64(4),
+			},
+		},
+	}
+
+	stats := &types.PodStats{}
+	fillBlockStats(stats, devices)
+
+	if len(stats.BlockStats) != 1 {
+		t.Fatalf("len(stats.BlockStats) = %d, want 1", len(stats.BlockStats))
+	}
+	got := stats.BlockStats[0]
+	if got.Device != "drive0" || got.ReadBytes != 100 || got.WriteBytes != 200 || got.ReadOps != 3 || got.WriteOps != 4 {
+		t.Errorf("stats.BlockStats[0] = %+v, want Device=drive0 ReadBytes=100 WriteBytes=200 ReadOps=3 WriteOps=4", got)
+	}
+}
+
+func TestReadProcStat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qemu-stats-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Field 14 (utime) = 111, field 15 (stime) = 222; the comm field
+	// deliberately contains spaces and parens to exercise the
+	// LastIndex(")") split in readProcStatFile.
+	line := "1234 (qemu system (x86_64)) S 1 1234 1234 0 -1 4194560 0 0 0 0 111 222 0 0 20 0 1 0\n"
+	if err := ioutil.WriteFile(fmt.Sprintf("%s/stat", dir), []byte(line), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	utime, stime, err := readProcStatFile(fmt.Sprintf("%s/stat", dir))
+	if err != nil {
+		t.Fatalf("readProcStatFile failed: %v", err)
+	}
+	if utime != 111 || stime != 222 {
+		t.Fatalf("readProcStatFile = (%d, %d), want (111, 222)", utime, stime)
+	}
+}
+
+func TestReadSysfsNetCounterMissingDevice(t *testing.T) {
+	if _, err := readSysfsNetCounter("no-such-nic-device", "rx_bytes"); err == nil {
+		t.Fatal("readSysfsNetCounter should fail for a nonexistent device")
+	}
+}
+
+func TestAsBool(t *testing.T) {
+	cases := []struct {
+		in   interface{}
+		want bool
+	}{
+		{true, true},
+		{false, false},
+		{nil, false},
+		{float64(1), false},
+	}
+	for _, c := range cases {
+		if got := asBool(c.in); got != c.want {
+			t.Errorf("asBool(%#v) = %v, want %v", c.in, got, c.want)
+		}
+	}
+}